@@ -6,6 +6,8 @@ package codec
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
 	"hash/crc32"
 	"io"
 	"net/rpc"
@@ -13,31 +15,86 @@ import (
 
 	"github.com/zehuamama/tinyrpc/compressor"
 	"github.com/zehuamama/tinyrpc/header"
+	"github.com/zehuamama/tinyrpc/mux"
 	"github.com/zehuamama/tinyrpc/serializer"
 )
 
+// defaultMaxMsgSize is the default cap on marshalled request/response body
+// size, matching gRPC's default of 4 MiB.
+const defaultMaxMsgSize = 4 * 1024 * 1024
+
 type clientCodec struct {
 	r io.Reader
 	w io.Writer
 	c io.Closer
 
-	compressor compressor.CompressType // rpc compress type(raw,gzip,snappy,zlib)
-	response   header.ResponseHeader   // rpc response header
-	mutex      sync.Mutex              // protect pending map
+	compressor compressor.CompressType  // rpc compress type(raw,gzip,snappy,zlib)
+	serializer serializer.SerializeType // rpc serialize type(proto,json,...)
+	response   header.ResponseHeader    // rpc response header
+	mutex      sync.Mutex               // protect pending map
 	pending    map[uint64]string
+
+	maxRecvMsgSize int // largest decompressed response body this codec will accept
+	maxSendMsgSize int // largest marshalled request body this codec will send
+}
+
+// ClientOption configures a clientCodec. Use it to override defaults such
+// as the serializer picked by NewClientCodec.
+type ClientOption func(*clientCodec)
+
+// WithSerializer sets the serializer used to marshal requests, in place of
+// the default serializer.Proto. Responses are unmarshalled with the
+// serializer their header names, and with this one only when that is not
+// registered.
+func WithSerializer(serializeType serializer.SerializeType) ClientOption {
+	return func(c *clientCodec) {
+		c.serializer = serializeType
+	}
+}
+
+// WithMaxRecvMsgSize caps the size of a decompressed response body this
+// codec will accept, guarding against zip-bomb-style payloads.
+func WithMaxRecvMsgSize(size int) ClientOption {
+	return func(c *clientCodec) {
+		c.maxRecvMsgSize = size
+	}
+}
+
+// WithMaxSendMsgSize caps the size of a marshalled request body this codec
+// will send.
+func WithMaxSendMsgSize(size int) ClientOption {
+	return func(c *clientCodec) {
+		c.maxSendMsgSize = size
+	}
 }
 
 // NewClientCodec Create a new client codec
 func NewClientCodec(conn io.ReadWriteCloser,
-	compressType compressor.CompressType) rpc.ClientCodec {
+	compressType compressor.CompressType, opts ...ClientOption) rpc.ClientCodec {
 
-	return &clientCodec{
-		r:          bufio.NewReader(conn),
-		w:          bufio.NewWriter(conn),
-		c:          conn,
-		compressor: compressType,
-		pending:    make(map[uint64]string),
+	c := &clientCodec{
+		r:              bufio.NewReader(conn),
+		w:              bufio.NewWriter(conn),
+		c:              conn,
+		compressor:     compressType,
+		serializer:     serializer.Proto,
+		pending:        make(map[uint64]string),
+		maxRecvMsgSize: defaultMaxMsgSize,
+		maxSendMsgSize: defaultMaxMsgSize,
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// NewMuxClientCodec opens a new virtual stream on session and wraps it in a
+// client codec, so many concurrent rpc codecs can share the one underlying
+// connection the session was built around instead of costing one
+// connection per call.
+func NewMuxClientCodec(session *mux.Session, compressType compressor.CompressType,
+	opts ...ClientOption) rpc.ClientCodec {
+	return NewClientCodec(session.Open(), compressType, opts...)
 }
 
 // WriteRequest Write the rpc request header and body to the io stream
@@ -45,7 +102,7 @@ func (c *clientCodec) WriteRequest(r *rpc.Request, param interface{}) error {
 	c.mutex.Lock()
 	c.pending[r.Seq] = r.ServiceMethod
 	c.mutex.Unlock()
-	err := writeRequest(c.w, r, c.compressor, param)
+	err := writeRequest(c.w, r, c.compressor, c.serializer, c.maxSendMsgSize, param)
 	if err != nil {
 		return err
 	}
@@ -72,18 +129,16 @@ func (c *clientCodec) ReadResponseHeader(r *rpc.Response) error {
 func (c *clientCodec) ReadResponseBody(param interface{}) error {
 	if param == nil {
 		if c.response.ResponseLen != 0 {
-			if err := read(c.r, make([]byte, c.response.ResponseLen)); err != nil {
+			buf := bufPool.Get()
+			defer bufPool.Put(buf)
+			if _, err := io.CopyN(buf, c.r, int64(c.response.ResponseLen)); err != nil {
 				return err
 			}
 		}
 		return nil
 	}
 
-	err := readResponseBody(c.r, &c.response, param)
-	if err != nil {
-		return nil
-	}
-	return nil
+	return readResponseBody(c.r, &c.response, c.serializer, c.maxRecvMsgSize, param)
 }
 
 func readResponseHeader(r io.Reader, h *header.ResponseHeader) error {
@@ -94,19 +149,45 @@ func readResponseHeader(r io.Reader, h *header.ResponseHeader) error {
 	return h.Unmarshal(data)
 }
 
-func writeRequest(w io.Writer, r *rpc.Request,
-	compressType compressor.CompressType, param interface{}) error {
-	if _, ok := compressor.Compressors[compressType]; !ok {
-		return NotFoundCompressorError
+// notFoundCompressorError names the specific missing codec, rather than a
+// generic NotFoundCompressorError, so the caller can tell at a glance which
+// compressor needs to be registered.
+func notFoundCompressorError(compressType compressor.CompressType) error {
+	return fmt.Errorf("tinyrpc: Decompressor is not installed for encoding %q", compressType)
+}
+
+func writeRequest(w io.Writer, r *rpc.Request, compressType compressor.CompressType,
+	serializeType serializer.SerializeType, maxSendMsgSize int, param interface{}) error {
+	comp, ok := compressor.Compressors[compressType]
+	if !ok {
+		return notFoundCompressorError(compressType)
 	}
-	reqBody, err := serializer.Serializers[serializer.Proto].Marshal(param)
+	s, ok := serializer.Serializers[serializeType]
+	if !ok {
+		return NotFoundSerializerError
+	}
+	reqBody, err := s.Marshal(param)
 	if err != nil {
 		return err
 	}
-	compressedReqBody, err := compressor.Compressors[compressType].Zip(reqBody)
+	if len(reqBody) > maxSendMsgSize {
+		return fmt.Errorf("tinyrpc: marshalled message is %d bytes, exceeds maxSendMsgSize %d",
+			len(reqBody), maxSendMsgSize)
+	}
+
+	compressedBuf := bufPool.Get()
+	defer bufPool.Put(compressedBuf)
+	zw, err := comp.Compress(compressedBuf)
 	if err != nil {
 		return err
 	}
+	if _, err := zw.Write(reqBody); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
 	h := header.RequestPool.Get().(*header.RequestHeader)
 	defer func() {
 		h.ResetHeader()
@@ -114,14 +195,15 @@ func writeRequest(w io.Writer, r *rpc.Request,
 	}()
 	h.ID = r.Seq
 	h.Method = r.ServiceMethod
-	h.RequestLen = uint32(len(compressedReqBody))
+	h.RequestLen = uint32(compressedBuf.Len())
 	h.CompressType = header.CompressType(compressType)
-	h.Checksum = crc32.ChecksumIEEE(compressedReqBody)
+	h.SerializeType = header.SerializeType(serializeType)
+	h.Checksum = crc32.ChecksumIEEE(compressedBuf.Bytes())
 
 	if err := sendFrame(w, h.Marshal()); err != nil {
 		return err
 	}
-	if err := write(w, compressedReqBody); err != nil {
+	if err := write(w, compressedBuf.Bytes()); err != nil {
 		return err
 	}
 
@@ -129,12 +211,18 @@ func writeRequest(w io.Writer, r *rpc.Request,
 	return nil
 }
 
-func readResponseBody(r io.Reader, h *header.ResponseHeader, param interface{}) error {
-	respBody := make([]byte, h.ResponseLen)
-	err := read(r, respBody)
-	if err != nil {
+func readResponseBody(r io.Reader, h *header.ResponseHeader,
+	serializeType serializer.SerializeType, maxRecvMsgSize int, param interface{}) error {
+	// The full ResponseLen is always read off the wire before the checksum
+	// is checked, so a mismatch here never leaves unread bytes behind: the
+	// connection stays frame-aligned and the caller can keep reading the
+	// next response.
+	buf := bufPool.Get()
+	defer bufPool.Put(buf)
+	if _, err := io.CopyN(buf, r, int64(h.ResponseLen)); err != nil {
 		return err
 	}
+	respBody := buf.Bytes()
 
 	if h.Checksum != 0 {
 		if crc32.ChecksumIEEE(respBody) != h.Checksum {
@@ -142,16 +230,39 @@ func readResponseBody(r io.Reader, h *header.ResponseHeader, param interface{})
 		}
 	}
 
-	if _, ok := compressor.Compressors[compressor.CompressType(h.CompressType)]; !ok {
-		return NotFoundCompressorError
+	comp, ok := compressor.Compressors[compressor.CompressType(h.CompressType)]
+	if !ok {
+		return notFoundCompressorError(compressor.CompressType(h.CompressType))
 	}
 
-	resp, err := compressor.Compressors[compressor.CompressType(h.CompressType)].Unzip(respBody)
+	zr, err := comp.Decompress(bytes.NewReader(respBody))
 	if err != nil {
 		return err
 	}
+	out := bufPool.Get()
+	defer bufPool.Put(out)
+	// Read one byte past the limit so an oversized, fully-decompressed
+	// message is rejected instead of silently truncated.
+	n, err := io.Copy(out, io.LimitReader(zr, int64(maxRecvMsgSize)+1))
+	if err != nil {
+		return err
+	}
+	if n > int64(maxRecvMsgSize) {
+		return fmt.Errorf("tinyrpc: decompressed message exceeds maxRecvMsgSize %d", maxRecvMsgSize)
+	}
+	resp := out.Bytes()
 
-	return serializer.Serializers[serializer.Proto].Unmarshal(resp, param)
+	// A server answering with its own SerializeType lets one server handle
+	// clients that each picked a different serializer, so prefer that over
+	// the type the client happened to request with.
+	s, ok := serializer.Serializers[serializer.SerializeType(h.SerializeType)]
+	if !ok {
+		s, ok = serializer.Serializers[serializeType]
+		if !ok {
+			return NotFoundSerializerError
+		}
+	}
+	return s.Unmarshal(resp, param)
 }
 
 func (c *clientCodec) Close() error {
@@ -0,0 +1,102 @@
+// Copyright 2022 <mzh.scnu@qq.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bytes"
+	"hash/crc32"
+	"testing"
+
+	"github.com/zehuamama/tinyrpc/compressor"
+	"github.com/zehuamama/tinyrpc/header"
+	"github.com/zehuamama/tinyrpc/serializer"
+)
+
+// TestReadResponseBody covers truncated frames, wrong checksums, and
+// unknown compressor ids, asserting the codec either recovers cleanly
+// (draining the frame so the next read stays aligned) or returns a
+// deterministic error instead of silently producing an empty response.
+func TestReadResponseBody(t *testing.T) {
+	body, err := compressor.Compressors[compressor.Raw].Zip(
+		mustMarshal(t, "hello"))
+	if err != nil {
+		t.Fatalf("zip: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		header      header.ResponseHeader
+		wantErr     bool
+		wantAligned bool // no unread bytes left on the stream after the call
+	}{
+		{
+			name: "ok",
+			header: header.ResponseHeader{
+				ResponseLen: uint32(len(body)),
+				Checksum:    crc32.ChecksumIEEE(body),
+			},
+			wantAligned: true,
+		},
+		{
+			name: "truncated frame",
+			header: header.ResponseHeader{
+				ResponseLen: uint32(len(body)) + 10,
+				Checksum:    crc32.ChecksumIEEE(body),
+			},
+			wantErr: true,
+		},
+		{
+			name: "wrong checksum",
+			header: header.ResponseHeader{
+				ResponseLen: uint32(len(body)),
+				Checksum:    crc32.ChecksumIEEE(body) + 1,
+			},
+			wantErr:     true,
+			wantAligned: true,
+		},
+		{
+			name: "unknown compressor",
+			header: header.ResponseHeader{
+				ResponseLen:  uint32(len(body)),
+				Checksum:     crc32.ChecksumIEEE(body),
+				CompressType: header.CompressType(255),
+			},
+			wantErr:     true,
+			wantAligned: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bytes.NewReader(body)
+			var out string
+			err := readResponseBody(r, &tt.header, serializer.Proto, defaultMaxMsgSize, &out)
+
+			if tt.wantErr && err == nil {
+				t.Fatal("expected an error, got nil")
+			}
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if out != "hello" {
+					t.Fatalf("got %q, want %q", out, "hello")
+				}
+			}
+			if tt.wantAligned && r.Len() != 0 {
+				t.Fatalf("%d unread bytes left on the stream, connection would desync", r.Len())
+			}
+		})
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	b, err := serializer.Serializers[serializer.Proto].Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	return b
+}
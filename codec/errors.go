@@ -0,0 +1,12 @@
+// Copyright 2022 <mzh.scnu@qq.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import "errors"
+
+// NotFoundSerializerError is returned when a request or response names a
+// serializer.SerializeType that has no registered serializer.Serializer,
+// mirroring NotFoundCompressorError for the compressor side.
+var NotFoundSerializerError = errors.New("tinyrpc: can not found serializer")
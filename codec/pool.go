@@ -0,0 +1,54 @@
+// Copyright 2022 <mzh.scnu@qq.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bytes"
+	"sync"
+)
+
+const (
+	initialBufferSize = 512
+	// maxRecycleBufferSize caps how large a buffer Put will recycle; bigger
+	// buffers are dropped so one oversized request/response doesn't pin that
+	// memory in the pool forever.
+	maxRecycleBufferSize = 8 * 1024 * 1024 // 8 MiB
+)
+
+// bufferPool is a sync.Pool of *bytes.Buffer used to avoid allocating a
+// fresh buffer for every request/response body and compression scratch
+// space.
+var bufPool = newBufferPool()
+
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool() *bufferPool {
+	return &bufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				return bytes.NewBuffer(make([]byte, 0, initialBufferSize))
+			},
+		},
+	}
+}
+
+// Get returns a reset, ready-to-use buffer, reusing a pooled one when
+// available.
+func (p *bufferPool) Get() *bytes.Buffer {
+	return p.pool.Get().(*bytes.Buffer)
+}
+
+// Put resets buf and returns it to the pool, unless it has grown beyond
+// maxRecycleBufferSize, in which case it is dropped so the pool doesn't
+// retain oversized buffers indefinitely.
+func (p *bufferPool) Put(buf *bytes.Buffer) {
+	if buf.Cap() > maxRecycleBufferSize {
+		return
+	}
+	buf.Reset()
+	p.pool.Put(buf)
+}
@@ -0,0 +1,28 @@
+// Copyright 2022 <mzh.scnu@qq.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+func BenchmarkBufferPool(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := bufPool.Get()
+		buf.Write(make([]byte, 1024))
+		bufPool.Put(buf)
+	}
+}
+
+func BenchmarkBufferAlloc(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := bytes.NewBuffer(make([]byte, 0, initialBufferSize))
+		buf.Write(make([]byte, 1024))
+		_ = buf
+	}
+}
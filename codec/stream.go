@@ -0,0 +1,518 @@
+// Copyright 2022 <mzh.scnu@qq.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/zehuamama/tinyrpc/compressor"
+	"github.com/zehuamama/tinyrpc/header"
+	"github.com/zehuamama/tinyrpc/serializer"
+)
+
+// StreamCodec is implemented by codecs that support sending and receiving
+// multiple frames for a single logical rpc call, identified by a shared Seq.
+// A connection handed to a stream codec carries stream frames only: its
+// reader loop discards frames that belong to no open Stream, so unary
+// responses are not delivered on it.
+type StreamCodec interface {
+	Send(param interface{}) error
+	Recv(param interface{}) error
+	CloseSend() error
+}
+
+// Stream represents one logical streaming rpc call. It is handed to the
+// method implementation on the server side, and returned to the caller by
+// NewStreamClient on the client side.
+type Stream struct {
+	seq        uint64
+	method     string
+	compressor compressor.CompressType
+	serializer serializer.SerializeType
+
+	w              io.Writer
+	wLock          *sync.Mutex
+	maxSendMsgSize int
+
+	// recvQueue buffers inbound frames the shared dispatchLoop/Serve reader
+	// goroutine has delivered but Recv hasn't consumed yet. It is
+	// deliberately unbounded (rather than a fixed-capacity channel) so a
+	// slow consumer on this stream never makes that shared reader goroutine
+	// block, which would otherwise stall every other stream multiplexed on
+	// the same connection.
+	recvMu    sync.Mutex
+	recvQueue []streamFrame
+	recvReady chan struct{}
+
+	closed  chan struct{}
+	once    sync.Once
+	sendEnd bool
+}
+
+type streamFrame struct {
+	data []byte
+	err  error
+	end  bool // true once the peer's StreamEnd frame has been queued
+}
+
+// Send marshals and writes param as a StreamData frame belonging to this
+// stream.
+func (s *Stream) Send(param interface{}) error {
+	return writeStreamFrame(s.w, s.wLock, s.seq, s.method, header.MsgTypeStreamData,
+		s.compressor, s.serializer, s.maxSendMsgSize, param)
+}
+
+// Recv blocks until the next frame for this stream arrives, decoding it
+// into param. It returns io.EOF once the peer has sent a StreamEnd frame.
+func (s *Stream) Recv(param interface{}) error {
+	for {
+		s.recvMu.Lock()
+		if len(s.recvQueue) > 0 {
+			f := s.recvQueue[0]
+			s.recvQueue = s.recvQueue[1:]
+			s.recvMu.Unlock()
+			if f.end {
+				return io.EOF
+			}
+			if f.err != nil {
+				return f.err
+			}
+			ser, ok := serializer.Serializers[s.serializer]
+			if !ok {
+				return NotFoundSerializerError
+			}
+			return ser.Unmarshal(f.data, param)
+		}
+		s.recvMu.Unlock()
+
+		select {
+		case <-s.recvReady:
+		case <-s.closed:
+			return io.EOF
+		}
+	}
+}
+
+// CloseSend sends a StreamEnd frame, telling the peer that no more data
+// will follow on this stream. It is safe to call more than once.
+func (s *Stream) CloseSend() error {
+	if s.sendEnd {
+		return nil
+	}
+	s.sendEnd = true
+	return writeStreamFrame(s.w, s.wLock, s.seq, s.method, header.MsgTypeStreamEnd,
+		s.compressor, s.serializer, s.maxSendMsgSize, nil)
+}
+
+// enqueue appends an inbound frame for this stream. It never blocks, so the
+// shared dispatchLoop/Serve reader goroutine can hand a frame off and
+// immediately go back to reading the next one regardless of how fast Recv
+// is being called.
+func (s *Stream) enqueue(f streamFrame) {
+	s.recvMu.Lock()
+	s.recvQueue = append(s.recvQueue, f)
+	s.recvMu.Unlock()
+	select {
+	case s.recvReady <- struct{}{}:
+	default:
+	}
+}
+
+// dispatch delivers an inbound frame to the stream, queuing a terminal
+// frame once a StreamEnd or Error frame has been seen so Recv eventually
+// observes io.EOF.
+func (s *Stream) dispatch(msgType header.MsgType, data []byte, err error) {
+	switch msgType {
+	case header.MsgTypeStreamEnd:
+		s.once.Do(func() { s.enqueue(streamFrame{end: true}) })
+	case header.MsgTypeError:
+		s.enqueue(streamFrame{err: err})
+		s.once.Do(func() { s.enqueue(streamFrame{end: true}) })
+	default:
+		s.enqueue(streamFrame{data: data, err: err})
+	}
+}
+
+func writeStreamFrame(w io.Writer, lock *sync.Mutex, seq uint64, method string,
+	msgType header.MsgType, compressType compressor.CompressType,
+	serializeType serializer.SerializeType, maxSendMsgSize int, param interface{}) error {
+	var body []byte
+	if param != nil {
+		ser, ok := serializer.Serializers[serializeType]
+		if !ok {
+			return NotFoundSerializerError
+		}
+		reqBody, err := ser.Marshal(param)
+		if err != nil {
+			return err
+		}
+		if len(reqBody) > maxSendMsgSize {
+			return fmt.Errorf("tinyrpc: marshalled message is %d bytes, exceeds maxSendMsgSize %d",
+				len(reqBody), maxSendMsgSize)
+		}
+		comp, ok := compressor.Compressors[compressType]
+		if !ok {
+			return notFoundCompressorError(compressType)
+		}
+		buf := bufPool.Get()
+		defer bufPool.Put(buf)
+		zw, err := comp.Compress(buf)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(reqBody); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	h := header.RequestPool.Get().(*header.RequestHeader)
+	defer func() {
+		h.ResetHeader()
+		header.RequestPool.Put(h)
+	}()
+	h.ID = seq
+	h.Method = method
+	h.MsgType = msgType
+	h.RequestLen = uint32(len(body))
+	h.CompressType = header.CompressType(compressType)
+	h.SerializeType = header.SerializeType(serializeType)
+
+	lock.Lock()
+	defer lock.Unlock()
+	if err := sendFrame(w, h.Marshal()); err != nil {
+		return err
+	}
+	if len(body) > 0 {
+		if err := write(w, body); err != nil {
+			return err
+		}
+	}
+	if bw, ok := w.(*bufio.Writer); ok {
+		return bw.Flush()
+	}
+	return nil
+}
+
+// ClientStreamCodec demultiplexes inbound frames onto per-stream receive
+// queues keyed by Seq, so many concurrent streaming calls can share one
+// clientCodec's connection.
+type ClientStreamCodec struct {
+	*clientCodec
+
+	streamMutex sync.Mutex
+	streams     map[uint64]*Stream
+}
+
+// NewStreamClient creates a client codec for opening streaming rpc calls.
+// Its dispatch loop reads every inbound frame off conn, so unary responses
+// are not delivered through the embedded rpc.ClientCodec methods.
+// opts configures the underlying clientCodec exactly as NewClientCodec
+// does, so WithSerializer also picks the serializer used for stream frames.
+func NewStreamClient(conn io.ReadWriteCloser, compressType compressor.CompressType,
+	opts ...ClientOption) *ClientStreamCodec {
+	cc := NewClientCodec(conn, compressType, opts...).(*clientCodec)
+	sc := &ClientStreamCodec{
+		clientCodec: cc,
+		streams:     make(map[uint64]*Stream),
+	}
+	go sc.dispatchLoop()
+	return sc
+}
+
+// NewStream opens a new stream for method, returning a Stream the caller
+// uses to Send/Recv frames until either side sends StreamEnd.
+func (c *ClientStreamCodec) NewStream(seq uint64, method string) *Stream {
+	s := &Stream{
+		seq:            seq,
+		method:         method,
+		compressor:     c.compressor,
+		serializer:     c.serializer,
+		w:              c.w,
+		wLock:          &c.mutex,
+		maxSendMsgSize: c.maxSendMsgSize,
+		recvReady:      make(chan struct{}, 1),
+		closed:         make(chan struct{}),
+	}
+	c.streamMutex.Lock()
+	c.streams[seq] = s
+	c.streamMutex.Unlock()
+	return s
+}
+
+// dispatchLoop reads frames off the wire and routes each one to the Stream
+// registered under its Seq, until the underlying connection is closed.
+func (c *ClientStreamCodec) dispatchLoop() {
+	for {
+		// Both sides write stream frames with writeStreamFrame, so the
+		// peer's frames carry a RequestHeader.
+		var resp header.RequestHeader
+		data, err := recvFrame(c.r)
+		if err != nil {
+			c.closeAllStreams()
+			return
+		}
+		if err := resp.Unmarshal(data); err != nil {
+			c.closeAllStreams()
+			return
+		}
+
+		c.streamMutex.Lock()
+		s, ok := c.streams[resp.ID]
+		c.streamMutex.Unlock()
+		if !ok {
+			// No stream is registered for this sequence; drain the body so
+			// the next frame on the wire stays aligned.
+			if resp.RequestLen != 0 {
+				_ = read(c.r, make([]byte, resp.RequestLen))
+			}
+			continue
+		}
+
+		var body []byte
+		if resp.RequestLen != 0 {
+			body = make([]byte, resp.RequestLen)
+			if err := read(c.r, body); err != nil {
+				s.dispatch(header.MsgTypeError, nil, err)
+				continue
+			}
+			comp, ok := compressor.Compressors[compressor.CompressType(resp.CompressType)]
+			if !ok {
+				s.dispatch(header.MsgTypeError, nil, notFoundCompressorError(compressor.CompressType(resp.CompressType)))
+				continue
+			}
+			zr, err := comp.Decompress(bytes.NewReader(body))
+			if err != nil {
+				s.dispatch(header.MsgTypeError, nil, err)
+				continue
+			}
+			// Read one byte past the limit so an oversized, fully
+			// decompressed frame is rejected instead of silently accepted,
+			// mirroring readResponseBody's zip-bomb guard for unary calls.
+			unzipped, err := io.ReadAll(io.LimitReader(zr, int64(c.maxRecvMsgSize)+1))
+			if err != nil {
+				s.dispatch(header.MsgTypeError, nil, err)
+				continue
+			}
+			if len(unzipped) > c.maxRecvMsgSize {
+				s.dispatch(header.MsgTypeError, nil,
+					fmt.Errorf("tinyrpc: decompressed message exceeds maxRecvMsgSize %d", c.maxRecvMsgSize))
+				continue
+			}
+			body = unzipped
+		}
+
+		msgType := header.MsgType(resp.MsgType)
+		s.dispatch(msgType, body, nil)
+		if msgType == header.MsgTypeStreamEnd {
+			c.streamMutex.Lock()
+			delete(c.streams, resp.ID)
+			c.streamMutex.Unlock()
+		}
+	}
+}
+
+func (c *ClientStreamCodec) closeAllStreams() {
+	c.streamMutex.Lock()
+	defer c.streamMutex.Unlock()
+	for seq, s := range c.streams {
+		close(s.closed)
+		delete(c.streams, seq)
+	}
+}
+
+// StreamHandler is implemented by stream methods, e.g.
+//
+//	func (s *S) Chat(stream *codec.Stream) error
+type StreamHandler func(stream *Stream) error
+
+// ServerStreamCodec tracks which registered methods are streaming methods
+// and routes frames for them to a per-call Stream instead of the normal
+// rpc.ServerCodec request/response path.
+type ServerStreamCodec struct {
+	r io.Reader
+	w io.Writer
+	c io.Closer
+
+	compressor compressor.CompressType
+	serializer serializer.SerializeType
+	handlers   map[string]StreamHandler
+
+	streamMutex sync.Mutex
+	streams     map[uint64]*Stream
+	wLock       sync.Mutex
+
+	maxRecvMsgSize int // largest decompressed request body this codec will accept
+	maxSendMsgSize int // largest marshalled stream frame this codec will send
+}
+
+// ServerOption configures a ServerStreamCodec.
+type ServerOption func(*ServerStreamCodec)
+
+// WithServerSerializer sets the serializer used to marshal and unmarshal
+// stream frames, in place of the default serializer.Proto.
+func WithServerSerializer(serializeType serializer.SerializeType) ServerOption {
+	return func(s *ServerStreamCodec) {
+		s.serializer = serializeType
+	}
+}
+
+// WithServerMaxRecvMsgSize caps the size of a decompressed request body this
+// codec will accept, guarding against zip-bomb-style payloads.
+func WithServerMaxRecvMsgSize(size int) ServerOption {
+	return func(s *ServerStreamCodec) {
+		s.maxRecvMsgSize = size
+	}
+}
+
+// WithServerMaxSendMsgSize caps the size of a marshalled stream frame this
+// codec will send.
+func WithServerMaxSendMsgSize(size int) ServerOption {
+	return func(s *ServerStreamCodec) {
+		s.maxSendMsgSize = size
+	}
+}
+
+// NewStreamServer creates a server-side dispatcher for streaming rpc calls.
+// Handlers must be registered with RegisterStream before Serve is called.
+func NewStreamServer(conn io.ReadWriteCloser, compressType compressor.CompressType,
+	opts ...ServerOption) *ServerStreamCodec {
+	s := &ServerStreamCodec{
+		r:              bufio.NewReader(conn),
+		w:              bufio.NewWriter(conn),
+		c:              conn,
+		compressor:     compressType,
+		serializer:     serializer.Proto,
+		handlers:       make(map[string]StreamHandler),
+		streams:        make(map[uint64]*Stream),
+		maxRecvMsgSize: defaultMaxMsgSize,
+		maxSendMsgSize: defaultMaxMsgSize,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Close closes the underlying connection.
+func (s *ServerStreamCodec) Close() error {
+	return s.c.Close()
+}
+
+// RegisterStream makes handler callable as method by clients that open a
+// stream with that name, e.g. "S.Chat".
+func (s *ServerStreamCodec) RegisterStream(method string, handler StreamHandler) {
+	s.handlers[method] = handler
+}
+
+// IsStreamMethod reports whether method was registered through
+// RegisterStream, so a generic dispatcher can tell streaming calls apart
+// from ordinary (req, resp) methods.
+func (s *ServerStreamCodec) IsStreamMethod(method string) bool {
+	_, ok := s.handlers[method]
+	return ok
+}
+
+// Serve reads frames off the connection until it is closed, starting a new
+// goroutine running the registered handler the first time a Seq is seen
+// and routing subsequent frames for that Seq to its Stream.
+func (s *ServerStreamCodec) Serve() error {
+	for {
+		var req header.RequestHeader
+		data, err := recvFrame(s.r)
+		if err != nil {
+			s.closeAllStreams()
+			return err
+		}
+		if err := req.Unmarshal(data); err != nil {
+			s.closeAllStreams()
+			return err
+		}
+
+		var body []byte
+		if req.RequestLen != 0 {
+			body = make([]byte, req.RequestLen)
+			if err := read(s.r, body); err != nil {
+				s.closeAllStreams()
+				return err
+			}
+			comp, ok := compressor.Compressors[compressor.CompressType(req.CompressType)]
+			if !ok {
+				s.closeAllStreams()
+				return notFoundCompressorError(compressor.CompressType(req.CompressType))
+			}
+			zr, err := comp.Decompress(bytes.NewReader(body))
+			if err != nil {
+				s.closeAllStreams()
+				return err
+			}
+			// Read one byte past the limit so an oversized, fully
+			// decompressed frame is rejected instead of silently accepted,
+			// mirroring readResponseBody's zip-bomb guard for unary calls.
+			if body, err = io.ReadAll(io.LimitReader(zr, int64(s.maxRecvMsgSize)+1)); err != nil {
+				s.closeAllStreams()
+				return err
+			}
+			if len(body) > s.maxRecvMsgSize {
+				s.closeAllStreams()
+				return fmt.Errorf("tinyrpc: decompressed message exceeds maxRecvMsgSize %d", s.maxRecvMsgSize)
+			}
+		}
+
+		msgType := header.MsgType(req.MsgType)
+		s.streamMutex.Lock()
+		stream, ok := s.streams[req.ID]
+		if !ok {
+			handler, ok := s.handlers[req.Method]
+			if !ok {
+				s.streamMutex.Unlock()
+				// No handler was ever registered for this method (stale
+				// client, typo, or a hostile peer); drop the frame instead
+				// of starting a goroutine that would call a nil
+				// StreamHandler and panic.
+				continue
+			}
+			stream = &Stream{
+				seq:            req.ID,
+				method:         req.Method,
+				compressor:     s.compressor,
+				serializer:     s.serializer,
+				w:              s.w,
+				wLock:          &s.wLock,
+				maxSendMsgSize: s.maxSendMsgSize,
+				recvReady:      make(chan struct{}, 1),
+				closed:         make(chan struct{}),
+			}
+			s.streams[req.ID] = stream
+			s.streamMutex.Unlock()
+			go func() {
+				_ = handler(stream)
+				s.streamMutex.Lock()
+				delete(s.streams, req.ID)
+				s.streamMutex.Unlock()
+			}()
+		} else {
+			s.streamMutex.Unlock()
+		}
+
+		stream.dispatch(msgType, body, nil)
+	}
+}
+
+func (s *ServerStreamCodec) closeAllStreams() {
+	s.streamMutex.Lock()
+	defer s.streamMutex.Unlock()
+	for seq, stream := range s.streams {
+		close(stream.closed)
+		delete(s.streams, seq)
+	}
+}
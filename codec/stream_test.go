@@ -0,0 +1,160 @@
+// Copyright 2022 <mzh.scnu@qq.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package codec
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/zehuamama/tinyrpc/compressor"
+)
+
+func newStreamPair(t *testing.T) (*ClientStreamCodec, *ServerStreamCodec) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	client := NewStreamClient(c1, compressor.Raw)
+	server := NewStreamServer(c2, compressor.Raw)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestStreamSendRecvCloseSend(t *testing.T) {
+	client, server := newStreamPair(t)
+	server.RegisterStream("Echo.Stream", func(stream *Stream) error {
+		var msg string
+		if err := stream.Recv(&msg); err != nil {
+			return err
+		}
+		if err := stream.Send(msg); err != nil {
+			return err
+		}
+		if err := stream.Recv(&msg); err != io.EOF {
+			return err
+		}
+		return stream.CloseSend()
+	})
+	go func() { _ = server.Serve() }()
+
+	cs := client.NewStream(1, "Echo.Stream")
+	if err := cs.Send("hello"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	var got string
+	if err := cs.Recv(&got); err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if got != "hello" {
+		t.Fatalf("got %q, want %q", got, "hello")
+	}
+	if err := cs.CloseSend(); err != nil {
+		t.Fatalf("CloseSend: %v", err)
+	}
+	if err := cs.Recv(&got); err != io.EOF {
+		t.Fatalf("got %v, want io.EOF", err)
+	}
+}
+
+// TestServeDropsUnregisteredMethod guards against a stream opened for a
+// method that was never passed to RegisterStream (typo, stale client, or a
+// hostile peer) panicking the server by calling a nil StreamHandler. It
+// also checks the dropped frame didn't wedge Serve's shared reader loop:
+// a second, registered stream must still work afterward.
+func TestServeDropsUnregisteredMethod(t *testing.T) {
+	client, server := newStreamPair(t)
+	server.RegisterStream("Echo.Stream", func(stream *Stream) error {
+		var msg string
+		if err := stream.Recv(&msg); err != nil {
+			return err
+		}
+		return stream.Send(msg)
+	})
+	go func() { _ = server.Serve() }()
+
+	unregistered := client.NewStream(1, "Nope.Method")
+	if err := unregistered.Send("hi"); err != nil {
+		t.Fatalf("Send(unregistered): %v", err)
+	}
+
+	cs := client.NewStream(2, "Echo.Stream")
+	if err := cs.Send("hello"); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	var got string
+	done := make(chan error, 1)
+	go func() { done <- cs.Recv(&got) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Recv: %v", err)
+		}
+		if got != "hello" {
+			t.Fatalf("got %q, want %q", got, "hello")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("registered stream was never served after an unregistered-method frame")
+	}
+}
+
+// TestSlowStreamConsumerDoesNotBlockOthers guards against the
+// head-of-line-blocking bug: a stream whose handler never calls Recv must
+// not stall delivery to every other stream sharing the same Serve reader
+// goroutine.
+func TestSlowStreamConsumerDoesNotBlockOthers(t *testing.T) {
+	client, server := newStreamPair(t)
+
+	fastDone := make(chan struct{})
+	server.RegisterStream("Slow.Stream", func(stream *Stream) error {
+		select {
+		case <-fastDone:
+		case <-stream.closed:
+		}
+		return nil
+	})
+	server.RegisterStream("Fast.Stream", func(stream *Stream) error {
+		var msg string
+		if err := stream.Recv(&msg); err != nil {
+			return err
+		}
+		defer close(fastDone)
+		return stream.Send(msg)
+	})
+	go func() { _ = server.Serve() }()
+
+	slow := client.NewStream(1, "Slow.Stream")
+	// Flood the slow stream with more frames than a fixed-capacity channel
+	// of 16 could hold, without ever registering a consumer that drains
+	// them.
+	for i := 0; i < 32; i++ {
+		if err := slow.Send("xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"); err != nil {
+			t.Fatalf("Send(slow): %v", err)
+		}
+	}
+
+	fast := client.NewStream(2, "Fast.Stream")
+	if err := fast.Send("hello"); err != nil {
+		t.Fatalf("Send(fast): %v", err)
+	}
+	var got string
+	done := make(chan error, 1)
+	go func() { done <- fast.Recv(&got) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Recv(fast): %v", err)
+		}
+		if got != "hello" {
+			t.Fatalf("got %q, want %q", got, "hello")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the fast stream; slow consumer blocked the shared reader")
+	}
+}
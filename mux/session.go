@@ -0,0 +1,212 @@
+// Copyright 2022 <mzh.scnu@qq.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mux multiplexes many virtual streams over a single underlying
+// connection, so a pool of concurrent rpc codecs can share one TCP
+// connection instead of costing one connection per call.
+package mux
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// initialWindowSize is the default per-stream flow-control credit. A
+// stream's reader replenishes credit as it consumes buffered data, so a
+// slow consumer on one stream can't starve the others on the same
+// connection.
+const initialWindowSize = 64 * 1024 // 64 KiB
+
+// maxFrameLength caps how large a single frame's payload may declare itself
+// to be. Without this, a corrupt or adversarial peer's 4-byte length prefix
+// could demand a multi-gigabyte allocation per frame; 16 MiB comfortably
+// covers the largest legitimate payload (one credit window) plus headroom.
+const maxFrameLength = 16 * 1024 * 1024
+
+// frame kinds, prefixed to every frame alongside the stream id.
+const (
+	frameData uint8 = iota
+	frameWindowUpdate
+	frameClose
+)
+
+// frame header: 1 byte kind + 4 byte stream id + 4 byte payload length.
+const frameHeaderSize = 1 + 4 + 4
+
+var errSessionClosed = errors.New("mux: session closed")
+
+// Session wraps a connection and hands out virtual Streams identified by a
+// uint32 stream id prepended to every frame. A single reader goroutine
+// dispatches inbound frames to the right stream's receive queue;
+// writers serialize through a mutex-guarded bufio.Writer.
+type Session struct {
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+
+	writeMutex sync.Mutex
+	w          *bufio.Writer
+
+	streamMutex sync.Mutex
+	streams     map[uint32]*Stream
+	nextID      uint32
+	accept      chan *Stream
+
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewSession wraps conn and starts the session's dispatch loop.
+func NewSession(conn io.ReadWriteCloser) *Session {
+	s := &Session{
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		w:       bufio.NewWriter(conn),
+		streams: make(map[uint32]*Stream),
+		closed:  make(chan struct{}),
+	}
+	go s.recvLoop()
+	return s
+}
+
+// Open creates a new virtual stream on this session. The caller side of a
+// connection should use Open; the callee side receives streams opened by
+// the peer through Accept.
+func (s *Session) Open() *Stream {
+	s.streamMutex.Lock()
+	defer s.streamMutex.Unlock()
+	s.nextID++
+	id := s.nextID
+	return s.newStreamLocked(id)
+}
+
+// Accept blocks until the peer opens a new stream, returning it.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case st := <-s.acceptCh():
+		return st, nil
+	case <-s.closed:
+		return nil, errSessionClosed
+	}
+}
+
+// acceptCh lazily creates the channel new inbound streams are delivered on.
+func (s *Session) acceptCh() chan *Stream {
+	s.streamMutex.Lock()
+	defer s.streamMutex.Unlock()
+	if s.accept == nil {
+		s.accept = make(chan *Stream, 16)
+	}
+	return s.accept
+}
+
+func (s *Session) newStreamLocked(id uint32) *Stream {
+	st := &Stream{
+		id:      id,
+		session: s,
+		window:  initialWindowSize,
+		closed:  make(chan struct{}),
+	}
+	st.init()
+	s.streams[id] = st
+	return st
+}
+
+// Close closes the session and every stream it is holding open.
+func (s *Session) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+		s.streamMutex.Lock()
+		for id, st := range s.streams {
+			st.closeLocked()
+			delete(s.streams, id)
+		}
+		s.streamMutex.Unlock()
+	})
+	return s.conn.Close()
+}
+
+// recvLoop reads frames off the wire and routes each one to the stream
+// registered under its id, until the connection is closed.
+func (s *Session) recvLoop() {
+	defer s.Close()
+	for {
+		kind, id, payload, err := s.readFrame()
+		if err != nil {
+			return
+		}
+
+		s.streamMutex.Lock()
+		st, ok := s.streams[id]
+		if !ok && kind == frameData {
+			st = s.newStreamLocked(id)
+			s.streamMutex.Unlock()
+			select {
+			case s.acceptCh() <- st:
+			case <-s.closed:
+				return
+			}
+		} else {
+			s.streamMutex.Unlock()
+		}
+		if st == nil {
+			continue
+		}
+
+		switch kind {
+		case frameData:
+			st.enqueue(payload)
+		case frameWindowUpdate:
+			st.addSendCredit(byteOrder.Uint32(payload))
+		case frameClose:
+			s.streamMutex.Lock()
+			delete(s.streams, id)
+			s.streamMutex.Unlock()
+			st.closeLocked()
+		}
+	}
+}
+
+func (s *Session) readFrame() (kind uint8, id uint32, payload []byte, err error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err = io.ReadFull(s.r, header); err != nil {
+		return 0, 0, nil, err
+	}
+	kind = header[0]
+	id = byteOrder.Uint32(header[1:5])
+	length := byteOrder.Uint32(header[5:9])
+	if length > maxFrameLength {
+		return 0, 0, nil, fmt.Errorf("mux: frame length %d exceeds maxFrameLength %d", length, maxFrameLength)
+	}
+	if length > 0 {
+		payload = make([]byte, length)
+		if _, err = io.ReadFull(s.r, payload); err != nil {
+			return 0, 0, nil, err
+		}
+	}
+	return kind, id, payload, nil
+}
+
+func (s *Session) writeFrame(kind uint8, id uint32, payload []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	var header [frameHeaderSize]byte
+	header[0] = kind
+	byteOrder.PutUint32(header[1:5], id)
+	byteOrder.PutUint32(header[5:9], uint32(len(payload)))
+	if _, err := s.w.Write(header[:]); err != nil {
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := s.w.Write(payload); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+var byteOrder = binary.BigEndian
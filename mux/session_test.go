@@ -0,0 +1,133 @@
+// Copyright 2022 <mzh.scnu@qq.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mux
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newSessionPair(t *testing.T) (client, server *Session) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	client = NewSession(c1)
+	server = NewSession(c2)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestSessionOpenAcceptRoundTrip(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	cs := client.Open()
+	done := make(chan error, 1)
+	go func() {
+		_, err := cs.Write([]byte("hello"))
+		done <- err
+	}()
+
+	ss, err := server.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(ss, buf); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("got %q, want %q", buf, "hello")
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+}
+
+// TestSlowConsumerDoesNotBlockOtherStreams guards against the
+// head-of-line-blocking bug: a stream whose consumer never calls Read must
+// not stall delivery to every other stream multiplexed on the same
+// session, since both streams share one underlying connection and one
+// dispatch goroutine.
+func TestSlowConsumerDoesNotBlockOtherStreams(t *testing.T) {
+	client, server := newSessionPair(t)
+
+	slow := client.Open()
+	fast := client.Open()
+
+	// Write far more than a single recvQueue entry to the slow stream's
+	// peer-facing side, but never drain it on the server side below: it
+	// gets at most one 4-byte Read.
+	go func() {
+		for i := 0; i < 64; i++ {
+			if _, err := slow.Write([]byte("xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx")); err != nil {
+				return
+			}
+		}
+	}()
+	go func() {
+		_, _ = fast.Write([]byte("fast"))
+	}()
+
+	// The accept order is not guaranteed, so accept both streams and read
+	// from whichever one actually carries "fast" without ever draining the
+	// slow stream.
+	results := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			st, err := server.Accept()
+			if err != nil {
+				results <- ""
+				return
+			}
+			buf := make([]byte, 4)
+			n, err := st.Read(buf)
+			if err != nil {
+				results <- ""
+				return
+			}
+			results <- string(buf[:n])
+		}()
+	}
+
+	timeout := time.After(2 * time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-results:
+			if got == "fast" {
+				return // fast stream was delivered without waiting on the slow one
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for the fast stream; slow consumer blocked the shared reader")
+		}
+	}
+	t.Fatal("fast stream was never delivered")
+}
+
+func TestSessionCloseUnblocksStreams(t *testing.T) {
+	client, server := newSessionPair(t)
+	_ = server
+
+	st := client.Open()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := st.Read(make([]byte, 1))
+		errc <- err
+	}()
+
+	client.Close()
+
+	select {
+	case err := <-errc:
+		if err != io.EOF {
+			t.Fatalf("got error %v, want io.EOF", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Read did not unblock after Session.Close")
+	}
+}
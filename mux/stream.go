@@ -0,0 +1,152 @@
+// Copyright 2022 <mzh.scnu@qq.com>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mux
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Stream is a virtual connection multiplexed over a Session. It implements
+// io.ReadWriteCloser so it can back a clientCodec/serverCodec exactly like
+// a plain net.Conn would.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	// recvQueue buffers inbound frames the session's single reader
+	// goroutine has dispatched but Read hasn't consumed yet. It is
+	// deliberately unbounded (rather than a fixed-capacity channel) so that
+	// a slow consumer on this stream never makes the shared reader goroutine
+	// block, which would otherwise stall every other stream on the
+	// connection; the peer's send-credit window still bounds how much data
+	// can actually be in flight at once.
+	recvMu    sync.Mutex
+	recvQueue [][]byte
+	recvReady chan struct{}
+	readBuf   bytes.Buffer
+	readMu    sync.Mutex
+
+	sendCredit int32 // bytes this stream is still allowed to write
+	sendCond   sync.Cond
+	sendMu     sync.Mutex
+
+	window uint32 // credit granted to the peer for reads on this stream
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (st *Stream) init() {
+	st.sendCredit = initialWindowSize
+	st.sendCond.L = &st.sendMu
+	st.recvReady = make(chan struct{}, 1)
+}
+
+// enqueue appends an inbound frame for this stream. It never blocks, so the
+// session's shared reader goroutine can hand off a frame and immediately go
+// back to reading the next one regardless of how fast Read is being called.
+func (st *Stream) enqueue(data []byte) {
+	st.recvMu.Lock()
+	st.recvQueue = append(st.recvQueue, data)
+	st.recvMu.Unlock()
+	select {
+	case st.recvReady <- struct{}{}:
+	default:
+	}
+}
+
+// Read implements io.Reader, blocking until data arrives or the stream is
+// closed. As buffered data is consumed, Read grants the peer more
+// send-credit so a slow local reader throttles only its own stream.
+func (st *Stream) Read(p []byte) (int, error) {
+	st.readMu.Lock()
+	defer st.readMu.Unlock()
+
+	for st.readBuf.Len() == 0 {
+		st.recvMu.Lock()
+		if len(st.recvQueue) > 0 {
+			data := st.recvQueue[0]
+			st.recvQueue = st.recvQueue[1:]
+			st.recvMu.Unlock()
+			st.readBuf.Write(data)
+			break
+		}
+		st.recvMu.Unlock()
+
+		select {
+		case <-st.recvReady:
+		case <-st.closed:
+			return 0, io.EOF
+		}
+	}
+	n, _ := st.readBuf.Read(p)
+	_ = st.session.writeFrame(frameWindowUpdate, st.id, windowUpdatePayload(uint32(n)))
+	return n, nil
+}
+
+// Write implements io.Writer. It blocks until enough send-credit is
+// available, so one slow consumer's window can't be overrun by a fast
+// writer on the same stream.
+func (st *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		st.sendMu.Lock()
+		for atomic.LoadInt32(&st.sendCredit) <= 0 {
+			select {
+			case <-st.closed:
+				st.sendMu.Unlock()
+				return written, io.ErrClosedPipe
+			default:
+			}
+			st.sendCond.Wait()
+		}
+		n := len(p) - written
+		if credit := int(atomic.LoadInt32(&st.sendCredit)); n > credit {
+			n = credit
+		}
+		st.sendMu.Unlock()
+
+		if err := st.session.writeFrame(frameData, st.id, p[written:written+n]); err != nil {
+			return written, err
+		}
+		atomic.AddInt32(&st.sendCredit, -int32(n))
+		written += n
+	}
+	return written, nil
+}
+
+// addSendCredit is called when a window-update frame arrives from the
+// peer, replenishing how much this stream may still Write.
+func (st *Stream) addSendCredit(n uint32) {
+	atomic.AddInt32(&st.sendCredit, int32(n))
+	st.sendMu.Lock()
+	st.sendCond.Broadcast()
+	st.sendMu.Unlock()
+}
+
+// Close tells the peer this stream is done and releases local resources.
+func (st *Stream) Close() error {
+	_ = st.session.writeFrame(frameClose, st.id, nil)
+	st.closeLocked()
+	return nil
+}
+
+func (st *Stream) closeLocked() {
+	st.closeOnce.Do(func() {
+		close(st.closed)
+		st.sendMu.Lock()
+		st.sendCond.Broadcast()
+		st.sendMu.Unlock()
+	})
+}
+
+func windowUpdatePayload(n uint32) []byte {
+	b := make([]byte, 4)
+	byteOrder.PutUint32(b, n)
+	return b
+}